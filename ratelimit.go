@@ -0,0 +1,144 @@
+package sand
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+//RateLimitError is returned by Client token acquisition when the OAuth2
+//server responds with 429 Too Many Requests and reports when it is safe to
+//try again.
+type RateLimitError struct {
+	//RetryAfter is how long the caller should wait before trying again.
+	RetryAfter time.Duration
+}
+
+func (e RateLimitError) Error() string {
+	return fmt.Sprintf("sand: rate limited by the OAuth2 server, retry after %s", e.RetryAfter)
+}
+
+//RateLimitPolicy controls how a Client detects and reacts to rate limiting
+//from the OAuth2 server.
+type RateLimitPolicy struct {
+	//RetryAfterHeader is the header inspected for a delta-seconds or
+	//HTTP-date retry hint. Default is "Retry-After".
+	RetryAfterHeader string
+	//RateLimitResetHeader is the header inspected for a Unix timestamp of
+	//when the rate limit window resets. Default is "X-RateLimit-Reset".
+	RateLimitResetHeader string
+}
+
+//DefaultRateLimitPolicy returns the standard header names used by most
+//OAuth2 servers to report rate limiting.
+func DefaultRateLimitPolicy() *RateLimitPolicy {
+	return &RateLimitPolicy{
+		RetryAfterHeader:     "Retry-After",
+		RateLimitResetHeader: "X-RateLimit-Reset",
+	}
+}
+
+//rateLimitPolicy returns the effective RateLimitPolicy for the client,
+//falling back to DefaultRateLimitPolicy() when none was configured.
+func (c *Client) rateLimitPolicy() *RateLimitPolicy {
+	if c.RateLimitPolicy != nil {
+		return c.RateLimitPolicy
+	}
+	return DefaultRateLimitPolicy()
+}
+
+//rateLimitedUntil reports the instant the server previously told this Client
+//to back off until, if that instant is still in the future.
+func (c *Client) rateLimitedUntil() (time.Time, bool) {
+	c.rateLimitMu.Lock()
+	defer c.rateLimitMu.Unlock()
+	if c.rateLimitUntil.IsZero() || !c.rateLimitUntil.After(time.Now()) {
+		return time.Time{}, false
+	}
+	return c.rateLimitUntil, true
+}
+
+//setRateLimitedUntil memoizes the instant until which this Client should
+//coalesce all token requests, guarded by rateLimitMu so concurrent
+//goroutines sharing the Client all wait for the same reset instant.
+func (c *Client) setRateLimitedUntil(until time.Time) {
+	c.rateLimitMu.Lock()
+	defer c.rateLimitMu.Unlock()
+	if until.After(c.rateLimitUntil) {
+		c.rateLimitUntil = until
+	}
+}
+
+//waitOutRateLimit blocks until any previously observed rate limit window on
+//this Client has passed, or ctx is cancelled. It is how concurrent callers
+//of oauthTokenContext coalesce onto a single reset instant instead of each
+//independently retrying against the OAuth2 server.
+func (c *Client) waitOutRateLimit(ctx context.Context) error {
+	until, limited := c.rateLimitedUntil()
+	if !limited {
+		return nil
+	}
+	return sleepContext(ctx, time.Until(until))
+}
+
+//checkRateLimit inspects err for a 429 response from the OAuth2 token
+//endpoint and, if found, returns how long to wait before retrying per the
+//RetryAfterHeader or RateLimitResetHeader.
+func (c *Client) checkRateLimit(err error) (time.Duration, bool) {
+	retrieveErr, ok := err.(*oauth2.RetrieveError)
+	if !ok || retrieveErr.Response == nil || retrieveErr.Response.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	policy := c.rateLimitPolicy()
+	resp := retrieveErr.Response
+	if wait, ok := parseRetryAfterHeader(resp, policy.RetryAfterHeader, time.Now()); ok {
+		return wait, true
+	}
+	if wait, ok := parseRateLimitReset(resp, policy.RateLimitResetHeader, time.Now()); ok {
+		return wait, true
+	}
+	return 0, false
+}
+
+//parseRetryAfterHeader parses name off of resp in either delta-seconds or
+//HTTP-date form.
+func parseRetryAfterHeader(resp *http.Response, name string, now time.Time) (time.Duration, bool) {
+	value := resp.Header.Get(name)
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		if wait := when.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+//parseRateLimitReset parses name off of resp as a Unix timestamp of when the
+//rate limit window resets.
+func parseRateLimitReset(resp *http.Response, name string, now time.Time) (time.Duration, bool) {
+	value := resp.Header.Get(name)
+	if value == "" {
+		return 0, false
+	}
+	reset, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if wait := time.Unix(reset, 0).Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
@@ -0,0 +1,63 @@
+package sand
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+//TestOAuthTokenRetriesThroughRateLimit verifies that a single call consumes
+//its own numRetry budget to wait out a 429 "Retry-After" window and succeeds
+//once the server recovers, instead of returning RateLimitError on the very
+//first 429 it sees.
+func TestOAuthTokenRetriesThroughRateLimit(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		if n == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"test-token","token_type":"bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	client, err := NewClient("id", "secret", server.URL)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	token, err := client.Token("some-service", []string{"s1"}, 5)
+	if err != nil {
+		t.Fatalf("Token(): unexpected error: %v", err)
+	}
+	if token != "test-token" {
+		t.Errorf("Token() = %q, want %q", token, "test-token")
+	}
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Errorf("expected 2 requests to the OAuth2 server (1 rate-limited + 1 success), got %d", got)
+	}
+}
+
+//TestOAuthTokenRateLimitExhaustsBudget verifies that once the retry budget
+//is exhausted while still rate-limited, the caller gets back a RateLimitError.
+func TestOAuthTokenRateLimitExhaustsBudget(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client, err := NewClient("id", "secret", server.URL)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	_, err = client.Token("some-service", []string{"s1"}, 1)
+	if _, ok := err.(RateLimitError); !ok {
+		t.Fatalf("Token() error = %v (%T), want RateLimitError", err, err)
+	}
+}
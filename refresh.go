@@ -0,0 +1,159 @@
+package sand
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+//refreshSkew returns the effective RefreshSkew, defaulting to 30 seconds.
+func (c *Client) refreshSkew() time.Duration {
+	if c.RefreshSkew > 0 {
+		return c.RefreshSkew
+	}
+	return 30 * time.Second
+}
+
+//stopCh returns the channel that signals background refresh goroutines to
+//stop. It must only be called while holding refreshMu.
+func (c *Client) stopCh() chan struct{} {
+	if c.closeCh == nil {
+		c.closeCh = make(chan struct{})
+	}
+	return c.closeCh
+}
+
+//Close stops any background token refreshers started by this Client and
+//waits for them to return. It also permanently disables BackgroundRefresh:
+//there is no way to recreate closeCh and resume spawning refresh goroutines,
+//so once Close returns, cacheToken falls back to shortening the cache TTL by
+//RefreshSkew instead, the same as a Client with BackgroundRefresh unset.
+//Close is safe to call more than once and is safe to call concurrently with
+//Token/Request.
+func (c *Client) Close() error {
+	c.refreshMu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.stopCh())
+	}
+	c.refreshMu.Unlock()
+	c.refreshWG.Wait()
+	return nil
+}
+
+//tryStartBackgroundRefresh registers a pending backgroundRefresh goroutine
+//with refreshWG and reports true, unless the Client is already closed, in
+//which case it reports false and registers nothing. Gating refreshWG.Add on
+//refreshMu, under which Close sets closed before it releases the lock and
+//calls refreshWG.Wait, means no Add from a zero count can follow the start
+//of Wait, which keeps Add and Wait from racing as sync.WaitGroup requires. It also makes
+//sure stopCh is initialized before the caller spawns its goroutine, so that
+//goroutine can read c.closeCh directly without taking refreshMu itself.
+func (c *Client) tryStartBackgroundRefresh() bool {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.stopCh()
+	c.refreshWG.Add(1)
+	return true
+}
+
+//cacheToken writes token under key with the given TTL. When BackgroundRefresh
+//is enabled, the full ttl is cached and a goroutine is spawned to refresh the
+//token in place once it is within RefreshSkew of expiring. Otherwise, ttl is
+//shortened by RefreshSkew so the cache entry itself goes missing early and
+//the next caller pays for a synchronous refresh. Once Close has been called,
+//BackgroundRefresh is treated as permanently disabled; see Close.
+func (c *Client) cacheToken(key, token string, ttl time.Duration, scopes []string) {
+	if !c.BackgroundRefresh || !c.tryStartBackgroundRefresh() {
+		skewed := ttl - c.refreshSkew()
+		if ttl > 0 && skewed <= 0 {
+			//Already within RefreshSkew of expiring: a ttl of 0 would mean no
+			//limit, so the token is not cached at all.
+			return
+		}
+		if skewed < 0 {
+			skewed = 0
+		}
+		c.Cache.Write(key, token, skewed)
+		return
+	}
+	c.Cache.Write(key, token, ttl)
+	refreshIn := ttl - c.refreshSkew()
+	if refreshIn <= 0 {
+		c.refreshWG.Done()
+		return
+	}
+	go c.backgroundRefresh(key, scopes, refreshIn)
+}
+
+//leaseCache is an optional extension of cache.Cache that a backend can
+//implement to make acquireLease's refresh lease a true atomic claim instead
+//of the racy read-then-write fallback described on acquireLease.
+type leaseCache interface {
+	//WriteIfAbsent writes value under key with the given ttl and reports
+	//true only if it did so because no value was present yet, atomically.
+	WriteIfAbsent(key string, value interface{}, ttl time.Duration) (bool, error)
+}
+
+//acquireLease claims leaseKey for ttl, reporting whether this call won the
+//claim. If c.Cache implements leaseCache, the claim is atomic and safe
+//across processes sharing the same cache backend.
+//
+//Otherwise this falls back to a plain Read followed by Write, which is a
+//known TOCTOU race: two callers (in this process or another process sharing
+//the cache) whose Read both observe no lease can both proceed to refresh.
+//cache.Cache has no compare-and-swap primitive to close this gap; implement
+//leaseCache on your cache.Cache to get an atomic lease.
+func (c *Client) acquireLease(leaseKey string, ttl time.Duration) bool {
+	if lc, ok := c.Cache.(leaseCache); ok {
+		acquired, err := lc.WriteIfAbsent(leaseKey, true, ttl)
+		if err != nil {
+			return false
+		}
+		return acquired
+	}
+	if c.Cache.Read(leaseKey) != nil {
+		return false
+	}
+	c.Cache.Write(leaseKey, true, ttl)
+	return true
+}
+
+//backgroundRefresh waits until refreshIn has elapsed (or the Client is
+//closed) and then refreshes the token cached under key, claiming a
+//short-lived lease first so that other processes sharing the same cache
+//backend don't duplicate the refresh. See acquireLease for the guarantees
+//this lease actually provides.
+func (c *Client) backgroundRefresh(key string, scopes []string, refreshIn time.Duration) {
+	defer c.refreshWG.Done()
+	timer := time.NewTimer(refreshIn)
+	defer timer.Stop()
+	select {
+	case <-c.closeCh:
+		return
+	case <-timer.C:
+	}
+
+	leaseKey := key + "/refresh-lease"
+	if !c.acquireLease(leaseKey, c.refreshSkew()) {
+		//Another process or goroutine already claimed the refresh.
+		return
+	}
+
+	token, err := c.oauthTokenContext(context.Background(), scopes, c.MaxRetry)
+	if err != nil || token.AccessToken == "" {
+		logger.Warnf("Sand background refresh: failed to refresh token for %s: %v", key, err)
+		return
+	}
+	expiresIn := 0
+	if !token.Expiry.IsZero() {
+		expiresIn = int(token.Expiry.Unix() - time.Now().Unix())
+	}
+	if expiresIn < 0 {
+		return
+	}
+	c.cacheToken(key, token.AccessToken, time.Duration(expiresIn)*time.Second, scopes)
+}
@@ -0,0 +1,140 @@
+package sand
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+//fakeLeaseCache is a minimal in-memory cache.Cache that also implements
+//leaseCache with a real compare-and-swap, used to test that acquireLease
+//takes the atomic path when available.
+type fakeLeaseCache struct {
+	mu     sync.Mutex
+	values map[string]interface{}
+	ttls   map[string]time.Duration
+}
+
+func newFakeLeaseCache() *fakeLeaseCache {
+	return &fakeLeaseCache{values: make(map[string]interface{}), ttls: make(map[string]time.Duration)}
+}
+
+func (f *fakeLeaseCache) Read(key string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.values[key]
+}
+
+func (f *fakeLeaseCache) Write(key string, value interface{}, ttl time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values[key] = value
+	f.ttls[key] = ttl
+}
+
+func (f *fakeLeaseCache) Delete(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.values, key)
+}
+
+func (f *fakeLeaseCache) WriteIfAbsent(key string, value interface{}, ttl time.Duration) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.values[key]; ok {
+		return false, nil
+	}
+	f.values[key] = value
+	return true, nil
+}
+
+//TestAcquireLeaseUsesAtomicPathWhenAvailable verifies that concurrent
+//acquireLease calls against a leaseCache-backed Cache let exactly one
+//caller win the lease, closing the race a plain Read-then-Write would have.
+func TestAcquireLeaseUsesAtomicPathWhenAvailable(t *testing.T) {
+	client := &Client{Cache: newFakeLeaseCache()}
+
+	const n = 50
+	var wg sync.WaitGroup
+	wins := make([]bool, n)
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			wins[i] = client.acquireLease("some-key/refresh-lease", time.Second)
+		}(i)
+	}
+	wg.Wait()
+
+	won := 0
+	for _, w := range wins {
+		if w {
+			won++
+		}
+	}
+	if won != 1 {
+		t.Errorf("expected exactly 1 of %d concurrent acquireLease calls to win, got %d", n, won)
+	}
+}
+
+//TestCloseDisablesBackgroundRefreshPermanently verifies that a cacheToken
+//call after Close falls back to shortening the cache TTL instead of silently
+//spawning a backgroundRefresh goroutine that would exit immediately on the
+//already-closed stopCh without ever refreshing.
+func TestCloseDisablesBackgroundRefreshPermanently(t *testing.T) {
+	client := &Client{Cache: newFakeLeaseCache(), BackgroundRefresh: true, RefreshSkew: time.Second}
+
+	if err := client.Close(); err != nil {
+		t.Fatalf("Close(): %v", err)
+	}
+
+	const ttl = 10 * time.Second
+	client.cacheToken("some-key", "token", ttl, []string{"s1"})
+
+	//A second Close must still return promptly after a post-Close cacheToken.
+	done := make(chan struct{})
+	go func() {
+		client.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("second Close() blocked after a post-Close cacheToken call")
+	}
+
+	cached, ok := client.Cache.Read("some-key").(string)
+	if !ok || cached != "token" {
+		t.Fatalf("Cache.Read(%q) = %v, want the cached token", "some-key", client.Cache.Read("some-key"))
+	}
+	//The fallback path caches the token for ttl minus RefreshSkew; the
+	//BackgroundRefresh path would have cached it for the full ttl.
+	fake := client.Cache.(*fakeLeaseCache)
+	fake.mu.Lock()
+	gotTTL := fake.ttls["some-key"]
+	fake.mu.Unlock()
+	if want := ttl - time.Second; gotTTL != want {
+		t.Errorf("cached TTL = %s, want %s (ttl shortened by RefreshSkew)", gotTTL, want)
+	}
+}
+
+//TestCloseDoesNotRaceWithConcurrentCacheToken exercises Close running
+//concurrently with cacheToken calls that may or may not win the race to
+//register with refreshWG before Close starts waiting. Run with -race.
+func TestCloseDoesNotRaceWithConcurrentCacheToken(t *testing.T) {
+	client := &Client{Cache: newFakeLeaseCache(), BackgroundRefresh: true, RefreshSkew: time.Millisecond}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client.cacheToken("some-key", "token", 10*time.Millisecond, []string{"s1"})
+		}(i)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatalf("Close(): %v", err)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,122 @@
+package sand
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+//RetryPolicy controls how a Client retries a failed request. It mirrors the
+//shape of github.com/hashicorp/go-retryablehttp's Client so the behavior is
+//familiar: Backoff computes how long to sleep between attempts, and
+//CheckRetry decides whether an attempt should be retried at all. The number
+//of retries Client performs comes from Client.MaxRetry or the per-call
+//numRetry; Client does not read RetryPolicy.MaxRetry.
+type RetryPolicy struct {
+	//RetryWaitMin is the minimum time to wait before the first retry.
+	RetryWaitMin time.Duration
+	//RetryWaitMax caps how long Backoff is allowed to sleep.
+	RetryWaitMax time.Duration
+	//MaxRetry is the maximum number of retries to perform. Client does not
+	//consult it; see Client.MaxRetry.
+	MaxRetry int
+	//Backoff computes how long to sleep before the next attempt. resp is the
+	//response from the previous attempt, or nil if that attempt returned an
+	//error instead of a response.
+	Backoff func(min, max time.Duration, attempt int, resp *http.Response) time.Duration
+	//CheckRetry decides whether a request should be retried, given the
+	//response and/or error from the previous attempt. Returning a non-nil
+	//error short-circuits any further retries and is returned to the caller.
+	CheckRetry func(ctx context.Context, resp *http.Response, err error) (bool, error)
+}
+
+//DefaultRetryPolicy returns a RetryPolicy that performs capped exponential
+//backoff with full jitter, honors a "Retry-After" header on 429/503
+//responses, and refuses to retry when the failure is a TLS trust error:
+//an untrusted certificate will not become valid on the next attempt, so
+//retrying only wastes the retry budget.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		RetryWaitMin: 1 * time.Second,
+		RetryWaitMax: 30 * time.Second,
+		MaxRetry:     5,
+		Backoff:      defaultBackoff,
+		CheckRetry:   defaultCheckRetry,
+	}
+}
+
+//defaultBackoff implements capped exponential backoff with full jitter. When
+//resp is a 429 or 503 carrying a "Retry-After" header, that value is honored
+//instead of the computed backoff.
+func defaultBackoff(min, max time.Duration, attempt int, resp *http.Response) time.Duration {
+	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if wait, ok := retryAfter(resp, time.Now()); ok {
+			return wait
+		}
+	}
+	mult := math.Pow(2, float64(attempt)) * float64(min)
+	sleep := time.Duration(mult)
+	if sleep <= 0 || sleep > max {
+		sleep = max
+	}
+	return time.Duration(rand.Int63n(int64(sleep) + 1))
+}
+
+//defaultCheckRetry returns false for context cancellation and for TLS trust
+//errors such as x509.UnknownAuthorityError or tls.CertificateVerificationError.
+//Any other error (e.g. a connection error) is retryable, as is a 429 or 5xx
+//response; any other response, or no response and no error, is not.
+func defaultCheckRetry(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if err != nil {
+		var unknownAuthority x509.UnknownAuthorityError
+		var hostnameError x509.HostnameError
+		var certVerification *tls.CertificateVerificationError
+		if errors.As(err, &unknownAuthority) || errors.As(err, &hostnameError) || errors.As(err, &certVerification) {
+			return false, nil
+		}
+		return true, nil
+	}
+	if resp == nil {
+		return false, nil
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return true, nil
+	}
+	return false, nil
+}
+
+//retryAfter parses the "Retry-After" header off of resp, supporting both the
+//delta-seconds and HTTP-date forms. now is the reference time used to turn
+//an HTTP-date into a duration; it is a parameter so tests can be deterministic.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		if wait := when.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
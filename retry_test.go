@@ -0,0 +1,92 @@
+package sand
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestDefaultBackoffHonorsRetryAfter(t *testing.T) {
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"2"}}}
+	got := defaultBackoff(time.Second, 30*time.Second, 0, resp)
+	if got != 2*time.Second {
+		t.Errorf("defaultBackoff() = %s, want 2s", got)
+	}
+}
+
+func TestDefaultBackoffCapsAtMax(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		got := defaultBackoff(time.Second, 5*time.Second, 10, nil)
+		if got > 5*time.Second {
+			t.Fatalf("defaultBackoff() = %s, want <= 5s", got)
+		}
+	}
+}
+
+func TestDefaultCheckRetryRejectsTLSTrustErrors(t *testing.T) {
+	ok, err := defaultCheckRetry(context.Background(), nil, x509.UnknownAuthorityError{})
+	if err != nil {
+		t.Fatalf("defaultCheckRetry() error = %v, want nil", err)
+	}
+	if ok {
+		t.Error("defaultCheckRetry() = true for x509.UnknownAuthorityError, want false (not retryable)")
+	}
+}
+
+func TestDefaultCheckRetryRetriesOtherErrors(t *testing.T) {
+	ok, err := defaultCheckRetry(context.Background(), nil, errTimeout{})
+	if err != nil {
+		t.Fatalf("defaultCheckRetry() error = %v, want nil", err)
+	}
+	if !ok {
+		t.Error("defaultCheckRetry() = false for a generic error, want true (retryable)")
+	}
+}
+
+func TestDefaultCheckRetryStopsOnCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ok, err := defaultCheckRetry(ctx, nil, errTimeout{})
+	if err == nil {
+		t.Fatal("defaultCheckRetry() error = nil, want ctx.Err()")
+	}
+	if ok {
+		t.Error("defaultCheckRetry() = true for a cancelled context, want false")
+	}
+}
+
+//errTimeout is a stand-in for a generic, retryable connection error.
+type errTimeout struct{}
+
+func (errTimeout) Error() string { return "i/o timeout" }
+
+//TestOAuthTokenDoesNotRetryTLSTrustError verifies that oauthTokenContext
+//gives up after a single attempt when the OAuth2 server presents a
+//certificate the client doesn't trust, instead of burning numRetry on a
+//failure mode that can't resolve itself.
+func TestOAuthTokenDoesNotRetryTLSTrustError(t *testing.T) {
+	var requests int
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"access_token":"test-token","token_type":"bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	//Deliberately do not trust the test server's self-signed certificate,
+	//and do not set SkipTLSVerify, so the client hits x509.UnknownAuthorityError.
+	client, err := NewClient("id", "secret", server.URL)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	if _, err := client.Token("some-service", []string{"s1"}, 5); err == nil {
+		t.Fatal("Token(): expected an error from an untrusted certificate, got nil")
+	}
+	if requests > 1 {
+		t.Errorf("expected at most 1 request against an untrusted-cert server, got %d", requests)
+	}
+}
@@ -3,9 +3,9 @@ package sand
 import (
 	"crypto/tls"
 	"errors"
-	"math"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/coupa/sand-go/cache"
@@ -13,6 +13,7 @@ import (
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
+	"golang.org/x/sync/singleflight"
 )
 
 //Client can be used to request token from an OAuth2 server
@@ -34,6 +35,45 @@ type Client struct {
 	MaxRetry int
 	Cache    cache.Cache
 
+	//NegativeCacheTTL is how long a failed token fetch (AuthenticationError)
+	//is cached under the request's cache key, so callers hammering an outage
+	//reuse the same failure instead of each rediscovering it.
+	//Default value is 1 second. Requires Cache to be set.
+	NegativeCacheTTL time.Duration
+
+	//RetryPolicy controls the backoff and retry-eligibility rules used when
+	//talking to the OAuth2 server. If nil, DefaultRetryPolicy() is used.
+	RetryPolicy *RetryPolicy
+
+	//RateLimitPolicy controls which headers are inspected to detect and
+	//honor rate limiting from the OAuth2 server. If nil, DefaultRateLimitPolicy()
+	//is used.
+	RateLimitPolicy *RateLimitPolicy
+
+	//RefreshSkew is how long before a cached token's real expiry it should be
+	//treated as expired, so a request doesn't pay the full OAuth2 round-trip
+	//latency right as the token runs out.
+	//Default value is 30 seconds.
+	RefreshSkew time.Duration
+
+	//BackgroundRefresh, when true, refreshes a cached token asynchronously as
+	//it nears expiry (RefreshSkew before its real expiry) instead of letting
+	//the cache entry itself expire early. Callers keep being served the
+	//still-valid cached token while the refresh happens in the background.
+	//Default is false.
+	//
+	//The refresh is guarded by a short-TTL lease key so that multiple
+	//processes sharing the same Cache backend don't duplicate the refresh.
+	//That guarantee is only atomic if Cache also implements leaseCache;
+	//plain cache.Cache backends fall back to a best-effort, racy
+	//read-then-write (see acquireLease).
+	//
+	//Once Close is called, BackgroundRefresh is permanently disabled for the
+	//rest of the Client's life: cacheToken reverts to shortening the cache
+	//TTL by RefreshSkew instead of spawning refresh goroutines. There is no
+	//way to re-enable it on a closed Client.
+	BackgroundRefresh bool
+
 	//CacheRoot is the root of the cache key for storing tokens in the cache.
 	//The overall cache key will look like: <CacheRoot>/<cacheType>/<some key>
 	//Default value is "sand"
@@ -42,6 +82,21 @@ type Client struct {
 	//Default value is "resources" for sand.Client
 	//Default value is "tokens" for sand.Service
 	cacheType string
+
+	//rateLimitMu guards rateLimitUntil so concurrent goroutines sharing this
+	//Client coalesce onto the same rate limit reset instant.
+	rateLimitMu    sync.Mutex
+	rateLimitUntil time.Time
+
+	//sf coalesces concurrent Token calls that miss the cache for the same key.
+	sf singleflight.Group
+
+	//refreshMu guards closed, closeCh, and registering refreshWG.Add calls
+	//so they never race with Close's refreshWG.Wait; see Close().
+	refreshMu sync.Mutex
+	closed    bool
+	closeCh   chan struct{}
+	refreshWG sync.WaitGroup
 }
 
 //NewClient returns a Client with default option values.
@@ -57,12 +112,22 @@ func NewClient(id, secret, tokenURL string) (client *Client, err error) {
 		SkipTLSVerify: false,
 		MaxRetry:      5,
 		Cache:         nil,
+		RetryPolicy:   DefaultRetryPolicy(),
 		CacheRoot:     "sand",
 		cacheType:     "resources",
 	}
 	return
 }
 
+//retryPolicy returns the effective RetryPolicy for the client, falling back
+//to DefaultRetryPolicy() when none was configured.
+func (c *Client) retryPolicy() *RetryPolicy {
+	if c.RetryPolicy != nil {
+		return c.RetryPolicy
+	}
+	return DefaultRetryPolicy()
+}
+
 //Request makes a service API request by first obtaining the access token from
 //SAND. Then it deligates the token to the underlying function to make the service
 //call. If the service returns 401, it performs exponential retry by requesting
@@ -77,15 +142,26 @@ func (c *Client) Request(cacheKey string, scopes []string, exec func(string) (*h
 	return c.RequestWithCustomRetry(cacheKey, scopes, c.MaxRetry, exec)
 }
 
+//RequestContext is like Request but allows the caller to cancel outstanding
+//backoff sleeps by cancelling ctx.
+func (c *Client) RequestContext(ctx context.Context, cacheKey string, scopes []string, exec func(string) (*http.Response, error)) (*http.Response, error) {
+	return c.RequestWithCustomRetryContext(ctx, cacheKey, scopes, c.MaxRetry, exec)
+}
+
 //RequestWithCustomRetry allows specifying numRetry as the number of retries to
 //use instead of the default MaxRetry, on a per-request basis.
 //Using a negative number for numRetry is equivalent to the "Request" function which uses MaxRetry.
-//The retry durations are: 1, 2, 4, 8, 16,... seconds
 func (c *Client) RequestWithCustomRetry(cacheKey string, scopes []string, numRetry int, exec func(string) (*http.Response, error)) (*http.Response, error) {
+	return c.RequestWithCustomRetryContext(context.Background(), cacheKey, scopes, numRetry, exec)
+}
+
+//RequestWithCustomRetryContext is RequestWithCustomRetry with a context.Context
+//that can cancel outstanding backoff sleeps between retries.
+func (c *Client) RequestWithCustomRetryContext(ctx context.Context, cacheKey string, scopes []string, numRetry int, exec func(string) (*http.Response, error)) (*http.Response, error) {
 	if numRetry < 0 {
 		numRetry = c.MaxRetry
 	}
-	token, err := c.Token(cacheKey, scopes, numRetry)
+	token, err := c.TokenContext(ctx, cacheKey, scopes, numRetry)
 	if err != nil {
 		return nil, err
 	}
@@ -94,19 +170,22 @@ func (c *Client) RequestWithCustomRetry(cacheKey string, scopes []string, numRet
 		return resp, err
 	}
 	if numRetry > 0 {
+		policy := c.retryPolicy()
 		//Retry only on 401 response from the service.
 		//Get a fresh token from authentication service and retry.
 		for retry := 0; resp.StatusCode == http.StatusUnauthorized && retry < numRetry; retry++ {
-			sleep := time.Duration(math.Pow(2, float64(retry)))
-			logger.Warnf("Sand request: retrying after %d sec on %d", sleep, http.StatusUnauthorized)
-			time.Sleep(sleep * time.Second)
+			sleep := policy.Backoff(policy.RetryWaitMin, policy.RetryWaitMax, retry, resp)
+			logger.Warnf("Sand request: retrying after %s on %d", sleep, http.StatusUnauthorized)
+			if err := sleepContext(ctx, sleep); err != nil {
+				return resp, err
+			}
 			//Prevent reading from cache on retry
 			if c.Cache != nil {
 				c.Cache.Delete(c.cacheKey(cacheKey, scopes))
 			}
 			//Set number of retry to 0, since we are already retrying here, don't retry
 			//when getting the token. Otherwise it may lock up for a long time
-			token, err = c.Token(cacheKey, scopes, 0)
+			token, err = c.TokenContext(ctx, cacheKey, scopes, 0)
 			if err != nil {
 				return resp, err
 			}
@@ -122,42 +201,82 @@ func (c *Client) RequestWithCustomRetry(cacheKey string, scopes []string, numRet
 //Token returns an OAuth token retrieved from the OAuth2 server. It also puts the
 //token in the cache up to specified amount of time.
 func (c *Client) Token(cacheKey string, scopes []string, numRetry int) (string, error) {
+	return c.TokenContext(context.Background(), cacheKey, scopes, numRetry)
+}
+
+//TokenContext is Token with a context.Context that can cancel outstanding
+//backoff sleeps while fetching a token from the OAuth2 server.
+func (c *Client) TokenContext(ctx context.Context, cacheKey string, scopes []string, numRetry int) (string, error) {
+	key := c.cacheKey(cacheKey, scopes)
 	if c.Cache != nil && cacheKey != "" {
-		token := c.Cache.Read(c.cacheKey(cacheKey, scopes))
-		if token != nil {
-			return token.(string), nil
+		if cached := c.Cache.Read(key); cached != nil {
+			if negative, ok := cached.(negativeCacheEntry); ok {
+				return "", negative.err
+			}
+			return cached.(string), nil
 		}
 	}
-	token, err := c.oauthToken(scopes, numRetry)
+	//Coalesce concurrent cache misses for the same key into a single
+	//request to the OAuth2 server instead of each caller retrying independently.
+	v, err, _ := c.sf.Do(key, func() (interface{}, error) {
+		token, err := c.oauthTokenContext(ctx, scopes, numRetry)
+		if err != nil {
+			return nil, err
+		}
+		if token.AccessToken == "" {
+			return nil, AuthenticationError{"Invalid access token"}
+		}
+		if c.Cache != nil && cacheKey != "" {
+			expiresIn := 0
+			//If token.Expiry is zero, it means no limit. Otherwise we compute the limit.
+			if !token.Expiry.IsZero() {
+				expiresIn = int(token.Expiry.Unix() - time.Now().Unix())
+			}
+			if expiresIn >= 0 {
+				c.cacheToken(key, token.AccessToken, time.Duration(expiresIn)*time.Second, scopes)
+			}
+		}
+		return token.AccessToken, nil
+	})
 	if err != nil {
+		if _, ok := err.(AuthenticationError); ok && c.Cache != nil && cacheKey != "" {
+			c.Cache.Write(key, negativeCacheEntry{err: err}, c.negativeCacheTTL())
+		}
 		return "", err
 	}
-	if token.AccessToken == "" {
-		return "", AuthenticationError{"Invalid access token"}
-	}
-	if c.Cache != nil && cacheKey != "" {
-		expiresIn := 0
-		//If token.Expiry is zero, it means no limit. Otherwise we compute the limit.
-		if !token.Expiry.IsZero() {
-			expiresIn = int(token.Expiry.Unix() - time.Now().Unix())
-		}
-		if expiresIn >= 0 {
-			c.Cache.Write(c.cacheKey(cacheKey, scopes), token.AccessToken, time.Duration(expiresIn)*time.Second)
-		}
+	return v.(string), nil
+}
+
+//negativeCacheEntry is cached under the token's cache key for NegativeCacheTTL
+//after an AuthenticationError, so a flapping OAuth2 server doesn't get hit by
+//every caller that would otherwise independently rediscover the same failure.
+type negativeCacheEntry struct {
+	err error
+}
+
+//negativeCacheTTL returns the effective negative-cache TTL, defaulting to 1 second.
+func (c *Client) negativeCacheTTL() time.Duration {
+	if c.NegativeCacheTTL > 0 {
+		return c.NegativeCacheTTL
 	}
-	return token.AccessToken, nil
+	return time.Second
 }
 
 //oauthToken makes the connection to the OAuth server and returns oauth2.Token
 //The returned token could have empty accessToken.
 func (c *Client) oauthToken(scopes []string, numRetry int) (token *oauth2.Token, err error) {
+	return c.oauthTokenContext(context.Background(), scopes, numRetry)
+}
+
+//oauthTokenContext is oauthToken with a context.Context threaded through both
+//the outgoing HTTP request and the backoff sleeps between retries.
+func (c *Client) oauthTokenContext(ctx context.Context, scopes []string, numRetry int) (token *oauth2.Token, err error) {
 	if numRetry < 0 {
 		numRetry = c.MaxRetry
 	}
 	client := &http.Client{Transport: &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: c.SkipTLSVerify},
 	}}
-	ctx := context.TODO()
 	ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
 
 	config := clientcredentials.Config{
@@ -166,14 +285,43 @@ func (c *Client) oauthToken(scopes []string, numRetry int) (token *oauth2.Token,
 		TokenURL:     c.TokenURL,
 		Scopes:       scopes,
 	}
-	token, err = config.Token(ctx)
-	if err != nil && numRetry > 0 {
-		for retry := 0; err != nil && retry < numRetry; retry++ {
-			//Exponential backoff on the retry
-			sleep := time.Duration(math.Pow(2, float64(retry)))
-			logger.Warnf("Sand token: retrying after %d sec because of error: %v", sleep, err)
-			time.Sleep(sleep * time.Second)
-			token, err = config.Token(ctx)
+	policy := c.retryPolicy()
+	//attempt 0 is the initial try; attempts 1..numRetry are retries, so the
+	//loop always makes at least one call to config.Token.
+	for attempt := 0; ; attempt++ {
+		if err = c.waitOutRateLimit(ctx); err != nil {
+			return nil, AuthenticationError{err.Error()}
+		}
+		token, err = config.Token(ctx)
+		if err == nil {
+			return token, nil
+		}
+		if wait, limited := c.checkRateLimit(err); limited {
+			c.setRateLimitedUntil(time.Now().Add(wait))
+			if attempt >= numRetry {
+				//Retry budget exhausted: stop waiting on SAND and let the caller decide.
+				return nil, RateLimitError{RetryAfter: wait}
+			}
+			logger.Warnf("Sand token: rate limited, retrying after %s", wait)
+			if sleepErr := sleepContext(ctx, wait); sleepErr != nil {
+				return nil, AuthenticationError{sleepErr.Error()}
+			}
+			continue
+		}
+		if attempt >= numRetry {
+			break
+		}
+		shouldRetry, checkErr := policy.CheckRetry(ctx, nil, err)
+		if checkErr != nil {
+			return token, AuthenticationError{checkErr.Error()}
+		}
+		if !shouldRetry {
+			break
+		}
+		sleep := policy.Backoff(policy.RetryWaitMin, policy.RetryWaitMax, attempt, nil)
+		logger.Warnf("Sand token: retrying after %s because of error: %v", sleep, err)
+		if sleepErr := sleepContext(ctx, sleep); sleepErr != nil {
+			return token, AuthenticationError{sleepErr.Error()}
 		}
 	}
 	if err != nil {
@@ -182,6 +330,18 @@ func (c *Client) oauthToken(scopes []string, numRetry int) (token *oauth2.Token,
 	return token, err
 }
 
+//sleepContext sleeps for d, returning early with ctx.Err() if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
 //cacheKey builds the cache key in the format: <CachRoot>/<cacheType>/<key>
 func (c *Client) cacheKey(key string, scopes []string) string {
 	rv := c.CacheRoot + "/" + c.cacheType + "/" + key
@@ -0,0 +1,52 @@
+package sand
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+//countingTokenServer returns an httptest.Server that answers client_credentials
+//token requests and a pointer to the number of requests it has served.
+func countingTokenServer() (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"test-token","token_type":"bearer","expires_in":3600}`))
+	}))
+	return server, &requests
+}
+
+func TestTokenCoalescesConcurrentCacheMisses(t *testing.T) {
+	server, requests := countingTokenServer()
+	defer server.Close()
+
+	client, err := NewClient("id", "secret", server.URL)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	const n = 20
+	var wg sync.WaitGroup
+	wg.Add(n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = client.Token("some-service", []string{"s1"}, 0)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Token() call %d: unexpected error: %v", i, err)
+		}
+	}
+	if got := atomic.LoadInt32(requests); got != 1 {
+		t.Errorf("expected exactly 1 token request for %d concurrent callers, got %d", n, got)
+	}
+}
@@ -0,0 +1,364 @@
+package sand
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coupa/sand-go/cache"
+	"github.com/golang-jwt/jwt/v5"
+
+	"golang.org/x/net/context"
+)
+
+//VerifyMode selects how Service.VerifyToken checks a token's validity.
+type VerifyMode int
+
+const (
+	//ModeIntrospect validates the token remotely via RFC 7662 token introspection.
+	ModeIntrospect VerifyMode = iota
+	//ModeJWT validates the token locally against a JWKS, without a round-trip to SAND.
+	ModeJWT
+	//ModeAuto tries ModeJWT first (when JWKSUrl is set) and falls back to
+	//ModeIntrospect only when the token cannot be evaluated locally; a JWT
+	//that is evaluated and found invalid is rejected without introspection.
+	ModeAuto
+)
+
+//Service verifies access tokens presented to a resource server, either by
+//asking SAND (introspection) or by validating a JWT locally against SAND's
+//published JWKS. Unlike Client, which acquires tokens, Service checks them.
+type Service struct {
+	//The client ID used to authenticate to IntrospectionURL.
+	ClientID string
+	//The client secret used to authenticate to IntrospectionURL.
+	ClientSecret string
+	//IntrospectionURL is SAND's RFC 7662 token introspection endpoint.
+	IntrospectionURL string
+	//JWKSUrl is SAND's JSON Web Key Set endpoint, used for local JWT validation.
+	JWKSUrl string
+	//Issuer, if set, is required to match the JWT "iss" claim exactly.
+	Issuer string
+	//Audience, if set, is required to appear in the JWT "aud" claim.
+	Audience string
+
+	//VerifyMode selects how VerifyToken checks a token. Default is ModeIntrospect.
+	VerifyMode VerifyMode
+
+	//SkipTLSVerify skips checking the SSL certificate. Should be false for production.
+	//Default is false
+	SkipTLSVerify bool
+
+	Cache cache.Cache
+
+	//CacheRoot is the root of the cache key for storing introspection results
+	//and JWKS responses in the cache.
+	//Default value is "sand"
+	CacheRoot string
+
+	cacheType string
+}
+
+//NewService returns a Service with default option values.
+func NewService(id, secret string) (service *Service, err error) {
+	if id == "" || secret == "" {
+		err = errors.New("NewService: missing required argument(s)")
+		return
+	}
+	service = &Service{
+		ClientID:     id,
+		ClientSecret: secret,
+		VerifyMode:   ModeIntrospect,
+		CacheRoot:    "sand",
+		cacheType:    "tokens",
+	}
+	return
+}
+
+//httpClient returns an *http.Client honoring SkipTLSVerify.
+func (s *Service) httpClient() *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: s.SkipTLSVerify},
+	}}
+}
+
+//VerifyToken reports whether token is currently active and, if scopes is
+//non-empty, whether it carries all of the requested scopes. The check is
+//performed per s.VerifyMode.
+func (s *Service) VerifyToken(token string, scopes []string) (bool, error) {
+	return s.VerifyTokenContext(context.Background(), token, scopes)
+}
+
+//VerifyTokenContext is VerifyToken with a context.Context for the outgoing
+//introspection or JWKS request, if one is needed.
+func (s *Service) VerifyTokenContext(ctx context.Context, token string, scopes []string) (bool, error) {
+	switch s.VerifyMode {
+	case ModeJWT:
+		return s.verifyJWT(ctx, token, scopes)
+	case ModeAuto:
+		if s.JWKSUrl != "" {
+			//A nil error means the JWT was decisively evaluated (valid or
+			//not); only fall back to introspection when verifyJWT couldn't
+			//evaluate it at all (errJWTIndeterminate).
+			active, err := s.verifyJWT(ctx, token, scopes)
+			if err == nil {
+				return active, nil
+			}
+			if !errors.Is(err, errJWTIndeterminate) {
+				return false, err
+			}
+		}
+		return s.verifyIntrospect(ctx, token, scopes)
+	default:
+		return s.verifyIntrospect(ctx, token, scopes)
+	}
+}
+
+//introspectionResponse is the subset of RFC 7662 fields this package checks.
+type introspectionResponse struct {
+	Active   bool   `json:"active"`
+	Exp      int64  `json:"exp"`
+	Scope    string `json:"scope"`
+	ClientID string `json:"client_id"`
+}
+
+//introspectionCacheKey returns the cache key an introspection result for
+//token is stored under: <CacheRoot>/introspection/<sha256(token)>.
+func (s *Service) introspectionCacheKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return s.CacheRoot + "/introspection/" + hex.EncodeToString(sum[:])
+}
+
+//verifyIntrospect performs RFC 7662 token introspection against
+//s.IntrospectionURL, caching the result until the token's "exp".
+func (s *Service) verifyIntrospect(ctx context.Context, token string, scopes []string) (bool, error) {
+	if s.IntrospectionURL == "" {
+		return false, errors.New("sand: Service.IntrospectionURL is not set")
+	}
+	key := s.introspectionCacheKey(token)
+	if s.Cache != nil {
+		if cached := s.Cache.Read(key); cached != nil {
+			resp := cached.(introspectionResponse)
+			return resp.Active && hasScopes(resp.Scope, scopes), nil
+		}
+	}
+
+	form := url.Values{"token": {token}}
+	req, err := http.NewRequest(http.MethodPost, s.IntrospectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(s.ClientID, s.ClientSecret)
+
+	httpResp, err := s.httpClient().Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("sand: introspection request failed with status %d", httpResp.StatusCode)
+	}
+
+	var resp introspectionResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return false, err
+	}
+	if s.Cache != nil && resp.Active && resp.Exp > 0 {
+		ttl := time.Duration(resp.Exp-time.Now().Unix()) * time.Second
+		if ttl > 0 {
+			s.Cache.Write(key, resp, ttl)
+		}
+	}
+	return resp.Active && hasScopes(resp.Scope, scopes), nil
+}
+
+//hasScopes reports whether every scope in want appears in the space-delimited granted string.
+func hasScopes(granted string, want []string) bool {
+	if len(want) == 0 {
+		return true
+	}
+	have := make(map[string]bool)
+	for _, s := range strings.Fields(granted) {
+		have[s] = true
+	}
+	for _, s := range want {
+		if !have[s] {
+			return false
+		}
+	}
+	return true
+}
+
+//jwk is a single JSON Web Key as published in a JWKS document. Only the
+//fields needed for RS256 verification are modeled.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+//jwksCacheKey is the single cache key the fetched JWKS document is stored
+//under: <CacheRoot>/jwks.
+func (s *Service) jwksCacheKey() string {
+	return s.CacheRoot + "/jwks"
+}
+
+//fetchJWKS returns the JWKS from s.JWKSUrl, serving it from Cache when
+//present and honoring the response's Cache-Control max-age otherwise.
+func (s *Service) fetchJWKS(ctx context.Context) (*jwks, error) {
+	key := s.jwksCacheKey()
+	if s.Cache != nil {
+		if cached := s.Cache.Read(key); cached != nil {
+			set := cached.(jwks)
+			return &set, nil
+		}
+	}
+	req, err := http.NewRequest(http.MethodGet, s.JWKSUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	resp, err := s.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("sand: JWKS request failed with status %d", resp.StatusCode)
+	}
+	var set jwks
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	if s.Cache != nil {
+		if ttl := maxAge(resp.Header.Get("Cache-Control")); ttl > 0 {
+			s.Cache.Write(key, set, ttl)
+		}
+	}
+	return &set, nil
+}
+
+//maxAge extracts max-age=N out of a Cache-Control header value, returning 0 if absent or invalid.
+func maxAge(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if secs, ok := strings.CutPrefix(directive, "max-age="); ok {
+			if n, err := strconv.Atoi(secs); err == nil && n > 0 {
+				return time.Duration(n) * time.Second
+			}
+		}
+	}
+	return 0
+}
+
+//errJWTIndeterminate marks a verifyJWT failure as "this token cannot be
+//evaluated against this JWKS" (unreachable JWKS, unsupported alg, unknown
+//kid) as opposed to "this token was evaluated and is invalid" (bad
+//signature, expired, not yet valid). ModeAuto falls back to introspection
+//only for the former; errors.Is distinguishes the two.
+var errJWTIndeterminate = errors.New("sand: token cannot be evaluated against this JWKS")
+
+//verifyJWT validates token locally against s.JWKSUrl's published keys,
+//checking alg/kid/iss/aud/exp/nbf and the requested scopes. A non-nil error
+//always wraps errJWTIndeterminate: the token was never decisively rejected,
+//only found unsuitable for local verification. A decisively invalid token
+//(bad signature, expired, not yet valid, wrong issuer/audience/scope)
+//returns (false, nil).
+func (s *Service) verifyJWT(ctx context.Context, token string, scopes []string) (bool, error) {
+	if s.JWKSUrl == "" {
+		return false, fmt.Errorf("%w: Service.JWKSUrl is not set", errJWTIndeterminate)
+	}
+	set, err := s.fetchJWKS(ctx)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", errJWTIndeterminate, err)
+	}
+
+	claims := jwt.MapClaims{}
+	parsed, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		alg, _ := t.Header["alg"].(string)
+		if alg != "RS256" {
+			return nil, fmt.Errorf("%w: unsupported JWT alg %q", errJWTIndeterminate, alg)
+		}
+		kid, _ := t.Header["kid"].(string)
+		key := findKey(set, kid)
+		if key == nil {
+			return nil, fmt.Errorf("%w: no JWKS key matching kid %q", errJWTIndeterminate, kid)
+		}
+		return key.publicKey()
+	})
+	if err != nil {
+		if errors.Is(err, errJWTIndeterminate) {
+			return false, err
+		}
+		//Parsed but decisively rejected: bad signature, expired, not yet valid, malformed, etc.
+		return false, nil
+	}
+	if !parsed.Valid {
+		return false, nil
+	}
+	if s.Issuer != "" {
+		if iss, _ := claims.GetIssuer(); iss != s.Issuer {
+			return false, nil
+		}
+	}
+	if s.Audience != "" {
+		aud, _ := claims.GetAudience()
+		found := false
+		for _, a := range aud {
+			if a == s.Audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	scope, _ := claims["scope"].(string)
+	return hasScopes(scope, scopes), nil
+}
+
+//findKey returns the JWK in set matching kid, or nil if none does.
+func findKey(set *jwks, kid string) *jwk {
+	for i := range set.Keys {
+		if set.Keys[i].Kid == kid {
+			return &set.Keys[i]
+		}
+	}
+	return nil
+}
+
+//publicKey decodes an RSA JWK's modulus/exponent into an *rsa.PublicKey.
+func (k *jwk) publicKey() (*rsa.PublicKey, error) {
+	nBytes, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	eBytes, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nBytes),
+		E: int(new(big.Int).SetBytes(eBytes).Int64()),
+	}, nil
+}
@@ -0,0 +1,122 @@
+package sand
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+//newTestJWKSServer signs tokens with a fresh RSA key under kid "test-key" and
+//serves the corresponding public JWKS from an httptest.Server.
+func newTestJWKSServer(t *testing.T) (*httptest.Server, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	set := jwks{Keys: []jwk{{
+		Kty: "RSA",
+		Kid: "test-key",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+	}}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(set)
+	}))
+	return server, key
+}
+
+func signTestToken(t *testing.T, key *rsa.PrivateKey, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test-key"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+	return signed
+}
+
+//TestVerifyTokenModeAutoRejectsExpiredJWTWithoutFallback verifies that an
+//expired-but-otherwise-valid JWT is decisively rejected by ModeAuto instead
+//of falling back to introspection (which may not even be configured).
+func TestVerifyTokenModeAutoRejectsExpiredJWTWithoutFallback(t *testing.T) {
+	jwksServer, key := newTestJWKSServer(t)
+	defer jwksServer.Close()
+
+	token := signTestToken(t, key, jwt.MapClaims{
+		"exp": time.Now().Add(-time.Hour).Unix(),
+	})
+
+	service, err := NewService("id", "secret")
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+	service.JWKSUrl = jwksServer.URL
+	service.VerifyMode = ModeAuto
+	//Deliberately no IntrospectionURL: a JWT-only deployment.
+
+	active, err := service.VerifyToken(token, nil)
+	if err != nil {
+		t.Fatalf("VerifyToken(): unexpected error: %v", err)
+	}
+	if active {
+		t.Error("VerifyToken() = true for an expired token, want false")
+	}
+}
+
+//TestVerifyTokenModeAutoFallsBackOnUnknownKid verifies that a JWT signed
+//with a kid absent from the JWKS (indeterminate, not decisively invalid)
+//falls back to introspection.
+func TestVerifyTokenModeAutoFallsBackOnUnknownKid(t *testing.T) {
+	jwksServer, _ := newTestJWKSServer(t)
+	defer jwksServer.Close()
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	token.Header["kid"] = "unknown-key"
+	signed, err := token.SignedString(otherKey)
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+
+	introspected := false
+	introspectServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		introspected = true
+		json.NewEncoder(w).Encode(introspectionResponse{Active: true})
+	}))
+	defer introspectServer.Close()
+
+	service, err := NewService("id", "secret")
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+	service.JWKSUrl = jwksServer.URL
+	service.IntrospectionURL = introspectServer.URL
+	service.VerifyMode = ModeAuto
+
+	active, err := service.VerifyToken(signed, nil)
+	if err != nil {
+		t.Fatalf("VerifyToken(): unexpected error: %v", err)
+	}
+	if !active {
+		t.Error("VerifyToken() = false, want true (from introspection fallback)")
+	}
+	if !introspected {
+		t.Error("expected VerifyToken to fall back to introspection for an unknown kid")
+	}
+}
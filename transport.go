@@ -0,0 +1,99 @@
+package sand
+
+import (
+	"errors"
+	"net/http"
+)
+
+//Transport returns an http.RoundTripper that authenticates outgoing requests
+//with a token obtained via c.Token(cacheKey, scopes, ...), so callers can use
+//standard http.Client semantics instead of the Request/exec closure pattern:
+//
+//	httpClient := &http.Client{Transport: client.Transport("some-service", []string{"s1", "s2"}, nil)}
+//	resp, err := httpClient.Get("https://service.example.com/resource")
+//
+//If base is nil, http.DefaultTransport is used as the underlying RoundTripper.
+func (c *Client) Transport(cacheKey string, scopes []string, base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &sandTransport{client: c, cacheKey: cacheKey, scopes: scopes, base: base}
+}
+
+//sandTransport is the http.RoundTripper returned by Client.Transport.
+type sandTransport struct {
+	client   *Client
+	cacheKey string
+	scopes   []string
+	base     http.RoundTripper
+}
+
+//RoundTrip injects a bearer token from the Client into req, and on a 401
+//response invalidates the cached token and retries once with a fresh one.
+//The request's context.Context is propagated throughout. The original body
+//is passed through untouched on the first attempt; only the retry after a
+//401 needs GetBody, since by then req.Body has already been consumed once.
+func (t *sandTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	token, err := t.client.TokenContext(ctx, t.cacheKey, t.scopes, t.client.MaxRetry)
+	if err != nil {
+		return nil, err
+	}
+
+	outReq := req.Clone(ctx)
+	outReq.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := t.base.RoundTrip(outReq)
+	if err != nil {
+		return resp, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	//Invalidate the cached token and retry once with a fresh one, honoring
+	//the configured RetryPolicy's backoff between the two attempts.
+	if t.client.Cache != nil {
+		t.client.Cache.Delete(t.client.cacheKey(t.cacheKey, t.scopes))
+	}
+	resp.Body.Close()
+
+	policy := t.client.retryPolicy()
+	if sleepErr := sleepContext(ctx, policy.Backoff(policy.RetryWaitMin, policy.RetryWaitMax, 0, resp)); sleepErr != nil {
+		return nil, sleepErr
+	}
+	token, err = t.client.TokenContext(ctx, t.cacheKey, t.scopes, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	retryReq, err := cloneRequestForRetry(req)
+	if err != nil {
+		return nil, err
+	}
+	retryReq.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(retryReq)
+}
+
+//cloneRequestForRetry returns a clone of req with a fresh copy of its body
+//obtained via GetBody, since req.Body has already been consumed by the
+//first attempt. A request with no body is cloned as is; a request with a
+//body but a nil GetBody cannot be replayed and is rejected with
+//errReplayWithoutGetBody.
+func cloneRequestForRetry(req *http.Request) (*http.Request, error) {
+	clone := req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return clone, nil
+	}
+	if req.GetBody == nil {
+		return nil, errReplayWithoutGetBody
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	clone.Body = body
+	return clone, nil
+}
+
+var errReplayWithoutGetBody = errors.New("sand: request body cannot be replayed: GetBody is not set")
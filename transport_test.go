@@ -0,0 +1,107 @@
+package sand
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+//newTestTokenServer returns an httptest.Server answering client_credentials
+//token requests with accessToken.
+func newTestTokenServer(accessToken string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"` + accessToken + `","token_type":"bearer","expires_in":3600}`))
+	}))
+}
+
+//TestTransportNoGetBodyRequired verifies a single-shot request with a body
+//that has no GetBody (e.g. built directly from an io.Reader) succeeds, since
+//nothing needs to be replayed when the service never returns a 401.
+func TestTransportNoGetBodyRequired(t *testing.T) {
+	tokenServer := newTestTokenServer("test-token")
+	defer tokenServer.Close()
+
+	var gotAuth string
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer service.Close()
+
+	client, err := NewClient("id", "secret", tokenServer.URL)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	httpClient := &http.Client{Transport: client.Transport("some-service", nil, nil)}
+	req, err := http.NewRequest(http.MethodPost, service.URL, struct{ io.Reader }{bytes.NewBufferString("payload")})
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	// Deliberately leave GetBody unset, as a hand-built request would.
+	req.GetBody = nil
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do(): unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if gotAuth != "Bearer test-token" {
+		t.Errorf("Authorization header = %q, want %q", gotAuth, "Bearer test-token")
+	}
+}
+
+//TestTransportRetriesOn401WithReplayableBody verifies that a request built
+//with a standard body (which has GetBody set by http.NewRequest) is retried
+//with a fresh token after a 401, and the retried request carries the full body.
+func TestTransportRetriesOn401WithReplayableBody(t *testing.T) {
+	tokenServer := newTestTokenServer("test-token")
+	defer tokenServer.Close()
+
+	var requests int32
+	var lastBody string
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		body, _ := io.ReadAll(r.Body)
+		lastBody = string(body)
+		if n == 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer service.Close()
+
+	client, err := NewClient("id", "secret", tokenServer.URL)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	httpClient := &http.Client{Transport: client.Transport("some-service", nil, nil)}
+	req, err := http.NewRequest(http.MethodPost, service.URL, bytes.NewBufferString("payload"))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do(): unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("final status = %d, want 200", resp.StatusCode)
+	}
+	if atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("expected 2 requests to the service (1 x 401 + 1 retry), got %d", requests)
+	}
+	if lastBody != "payload" {
+		t.Errorf("retried request body = %q, want %q", lastBody, "payload")
+	}
+}